@@ -2,16 +2,16 @@ package action_cache_server
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
+	"strconv"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/policy"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/golang/protobuf/proto"
-	"github.com/google/uuid"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
@@ -23,6 +23,21 @@ const (
 type ActionCacheServer struct {
 	env   environment.Env
 	cache interfaces.DigestCache
+
+	// index is the optional sidecar metadata index used by
+	// PruneActionCache / StartGCLoop to find GC candidates without scanning
+	// the underlying blob store. Nil disables GC.
+	index entryIndex
+
+	// policy is the optional ActionPolicy consulted on every read and
+	// write. Nil means "allow everything", preserving today's behavior.
+	policy policy.ActionPolicy
+}
+
+// deletableCache is implemented by DigestCache implementations that support
+// removing entries, needed for action cache GC.
+type deletableCache interface {
+	Delete(ctx context.Context, d *repb.Digest) error
 }
 
 func NewActionCacheServer(env environment.Env) (*ActionCacheServer, error) {
@@ -36,6 +51,18 @@ func NewActionCacheServer(env environment.Env) (*ActionCacheServer, error) {
 	}, nil
 }
 
+// SetIndex configures the sidecar metadata index used by PruneActionCache
+// and StartGCLoop. Callers that don't need GC can leave it unset.
+func (s *ActionCacheServer) SetIndex(idx entryIndex) {
+	s.index = idx
+}
+
+// SetPolicy configures the ActionPolicy consulted on every read and write.
+// Callers that don't need access control can leave it unset.
+func (s *ActionCacheServer) SetPolicy(p policy.ActionPolicy) {
+	s.policy = p
+}
+
 func (s *ActionCacheServer) checkFilesExist(ctx context.Context, digests []*repb.Digest) error {
 	foundMap, err := s.cache.ContainsMulti(ctx, digests)
 	if err != nil {
@@ -53,7 +80,7 @@ func (s *ActionCacheServer) checkFilesExist(ctx context.Context, digests []*repb
 	return nil
 }
 
-func (s *ActionCacheServer) checkDirExists(ctx context.Context, dir *repb.Directory) error {
+func dirFileDigests(dir *repb.Directory) []*repb.Digest {
 	digests := make([]*repb.Digest, 0, len(dir.GetFiles()))
 	for _, f := range dir.GetFiles() {
 		if f.Digest == nil {
@@ -61,46 +88,95 @@ func (s *ActionCacheServer) checkDirExists(ctx context.Context, dir *repb.Direct
 		}
 		digests = append(digests, f.GetDigest())
 	}
-	return s.checkFilesExist(ctx, digests)
+	return digests
 }
 
+// validateActionResult confirms that every blob an ActionResult references
+// (output files, plus every file in every OutputDirectory's Tree) is still
+// present in the CAS. For a wide tree this used to cost one cache.Get per
+// OutputDirectory and one ContainsMulti per directory within it; instead we
+// hoist all tree fetches into a single GetMulti and collect every leaf file
+// digest across the whole ActionResult into a single ContainsMulti.
 func (s *ActionCacheServer) validateActionResult(ctx context.Context, r *repb.ActionResult) error {
-	outputFileDigests := make([]*repb.Digest, 0, len(r.OutputFiles))
-	for _, f := range r.OutputFiles {
-		if len(f.Contents) > 0 && f.GetDigest().GetSizeBytes() > 0 {
-			outputFileDigests = append(outputFileDigests, f.GetDigest())
-		}
+	treeDigests := make([]*repb.Digest, 0, len(r.OutputDirectories))
+	for _, d := range r.OutputDirectories {
+		treeDigests = append(treeDigests, d.GetTreeDigest())
 	}
-	if err := s.checkFilesExist(ctx, outputFileDigests); err != nil {
+	treeBlobs, err := s.getTreeBlobs(ctx, treeDigests)
+	if err != nil {
 		return err
 	}
 
-	for _, d := range r.OutputDirectories {
-		blob, err := s.cache.Get(ctx, d.GetTreeDigest())
-		if err != nil {
-			return err
+	leafDigests := make([]*repb.Digest, 0, len(r.OutputFiles))
+	for _, f := range r.OutputFiles {
+		if f.GetDigest().GetSizeBytes() > 0 {
+			leafDigests = append(leafDigests, f.GetDigest())
+		}
+	}
+	for _, td := range treeDigests {
+		blob, ok := treeBlobs[digestKey(td)]
+		if !ok {
+			return status.NotFoundErrorf("ActionResult OutputDirectory tree %q not found in cache", td)
 		}
 		tree := &repb.Tree{}
 		if err := proto.Unmarshal(blob, tree); err != nil {
 			return err
 		}
-		if err := s.checkDirExists(ctx, tree.Root); err != nil {
-			return err
-		}
-
+		leafDigests = append(leafDigests, dirFileDigests(tree.GetRoot())...)
 		for _, childDir := range tree.GetChildren() {
-			if err := s.checkDirExists(ctx, childDir); err != nil {
-				return err
-			}
+			leafDigests = append(leafDigests, dirFileDigests(childDir)...)
 		}
 	}
-	return nil
+	return s.checkFilesExist(ctx, leafDigests)
+}
+
+// digestKey returns a value (as opposed to pointer) key for d, suitable for
+// indexing maps keyed by digest identity. Digest protos for the same
+// blob aren't guaranteed to be the same pointer -- e.g. a multiGetCache may
+// return freshly-allocated *repb.Digest values for its result map -- so
+// map[*repb.Digest]... is not safe to index into with the digests we passed
+// in; we re-key through digestKey instead.
+func digestKey(d *repb.Digest) string {
+	return d.GetHash() + "/" + strconv.FormatInt(d.GetSizeBytes(), 10)
 }
 
-func setWorkerMetadata(ar *repb.ActionResult) {
-	ar.ExecutionMetadata = &repb.ExecutedActionMetadata{
-		Worker: base64.StdEncoding.EncodeToString(uuid.NodeID()),
+// multiGetCache is implemented by DigestCache implementations that can fetch
+// several blobs in a single round trip. This mirrors
+// interfaces.DigestCache.GetMulti's production signature, keyed by
+// *repb.Digest pointer -- getTreeBlobs re-keys the result through digestKey
+// before using it, rather than assuming pointer identity.
+type multiGetCache interface {
+	GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error)
+}
+
+// getTreeBlobs fetches the marshaled Tree proto for each of digests, using a
+// single GetMulti round-trip when the cache supports it and falling back to
+// one Get per digest otherwise. The result is keyed by digestKey, since
+// GetMulti's own result map isn't guaranteed to be keyed by the *repb.Digest
+// pointers we passed in.
+func (s *ActionCacheServer) getTreeBlobs(ctx context.Context, digests []*repb.Digest) (map[string][]byte, error) {
+	if len(digests) == 0 {
+		return nil, nil
+	}
+	blobs := make(map[string][]byte, len(digests))
+	if mg, ok := s.cache.(multiGetCache); ok {
+		result, err := mg.GetMulti(ctx, digests)
+		if err != nil {
+			return nil, err
+		}
+		for d, blob := range result {
+			blobs[digestKey(d)] = blob
+		}
+		return blobs, nil
+	}
+	for _, d := range digests {
+		blob, err := s.cache.Get(ctx, d)
+		if err != nil {
+			return nil, err
+		}
+		blobs[digestKey(d)] = blob
 	}
+	return blobs, nil
 }
 
 // Retrieve a cached execution result.
@@ -125,9 +201,13 @@ func (s *ActionCacheServer) GetActionResult(ctx context.Context, req *repb.GetAc
 	}
 	ctx = perms.AttachUserPrefixToContext(ctx, s.env)
 
-	// Fetch the "ActionResult" object which enumerates all the files in the action.
 	d := req.GetActionDigest()
-	blob, err := s.cache.Get(ctx, d)
+	if err := s.checkRead(ctx, d); err != nil {
+		return nil, err
+	}
+
+	// Fetch the "ActionResult" object which enumerates all the files in the action.
+	blob, err := s.getActionResultBlob(ctx, d)
 	if err != nil {
 		return nil, status.NotFoundError(fmt.Sprintf("ActionResult (%s) not found: %s", d, err))
 	}
@@ -139,6 +219,7 @@ func (s *ActionCacheServer) GetActionResult(ctx context.Context, req *repb.GetAc
 	if err := s.validateActionResult(ctx, rsp); err != nil {
 		return nil, status.NotFoundError(fmt.Sprintf("ActionResult (%s) not found: %s", d, err))
 	}
+	s.touchActionResult(ctx, d, rsp, int64(len(blob)), perms.UserPrefixFromContext(ctx))
 	return rsp, nil
 }
 
@@ -171,17 +252,62 @@ func (s *ActionCacheServer) UpdateActionResult(ctx context.Context, req *repb.Up
 	}
 	ctx = perms.AttachUserPrefixToContext(ctx, s.env)
 
+	if err := s.checkWrite(ctx, req.GetActionDigest()); err != nil {
+		return nil, err
+	}
+
 	// Context: https://github.com/bazelbuild/remote-apis/pull/131
 	// More: https://github.com/buchgr/bazel-remote/commit/7de536f47bf163fb96bc1e38ffd5e444e2bcaa00
-	setWorkerMetadata(req.ActionResult)
+	if err := applyExecutionMetadata(req.ActionResult); err != nil {
+		return nil, err
+	}
 
 	blob, err := proto.Marshal(req.ActionResult)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := s.cache.Set(ctx, req.GetActionDigest(), blob); err != nil {
+	if err := s.setActionResultBlob(ctx, req.GetActionDigest(), blob); err != nil {
 		return nil, err
 	}
+	s.touchActionResult(ctx, req.GetActionDigest(), req.ActionResult, int64(len(blob)), perms.UserPrefixFromContext(ctx))
 	return req.ActionResult, nil
 }
+
+// zstdCache is the sub-cache compressed ActionResult blobs are stored under,
+// namespaced the same way s.cache itself is namespaced off the root digest
+// cache (see NewActionCacheServer): by prefixing, not by mutating digests.
+// Mutating a digest's hash to forge a cache key would produce a hash that
+// isn't valid hex for the digest function, which a cache that validates
+// digest format on Set/Get would reject.
+func (s *ActionCacheServer) zstdCache() interfaces.DigestCache {
+	return s.cache.WithPrefix(zstdBlobPrefix)
+}
+
+// getActionResultBlob fetches the marshaled ActionResult for d, preferring
+// the zstd-compressed copy (and decompressing it transparently) if one
+// exists, falling back to the uncompressed copy otherwise -- e.g. for
+// entries written before compression was enabled.
+func (s *ActionCacheServer) getActionResultBlob(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	compressed, err := s.zstdCache().Get(ctx, d)
+	if err != nil {
+		// No compressed copy on hand -- fall back to the uncompressed path.
+		return s.cache.Get(ctx, d)
+	}
+	blob, err := zstdDecompress(compressed)
+	if err != nil {
+		return nil, status.InternalErrorf("AC failed to decompress zstd blob %q: %s", d, err)
+	}
+	return blob, nil
+}
+
+// setActionResultBlob stores the marshaled ActionResult for d, compressed
+// with zstd, under the zstdCache namespace. Clients that haven't opted in to
+// compressed-blobs still read it back transparently via getActionResultBlob.
+func (s *ActionCacheServer) setActionResultBlob(ctx context.Context, d *repb.Digest, blob []byte) error {
+	compressed := zstdCompress(blob)
+	if len(compressed) == 0 && len(blob) > 0 {
+		return status.InternalErrorf("AC zstd compression of %q produced an empty result", d)
+	}
+	return s.zstdCache().Set(ctx, d, compressed)
+}
@@ -0,0 +1,166 @@
+package action_cache_server
+
+import (
+	"context"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// The batching and client-session sync logic below is implemented as plain
+// Go methods on ActionCacheServer, not as gRPC handlers: a
+// BatchGetActionResults/BatchUpdateActionResults RPC pair and a streaming
+// ValidateAndSync RPC both require new messages and a new/extended service
+// definition in the ActionCache proto, which isn't available in this tree.
+//
+// TODO(action-cache-grpc-surface): wiring an actual RPC surface on top of
+// these methods (request/response proto messages, service registration, and
+// for ValidateAndSync a server-streaming handler) is tracked follow-up work,
+// not done here -- these methods are what such handlers would call into, but
+// until that proto exists no client can reach them over the wire.
+
+// BatchGetActionResults fetches many ActionResults in one call so a client
+// with a lot of cache hits to check (e.g. a fresh Bazel invocation warming
+// its local cache) doesn't have to pay a round trip per action.
+//
+// Each result is reported independently: a NOT_FOUND for one digest doesn't
+// fail the whole batch.
+type BatchGetActionResultsResult struct {
+	ActionDigest *repb.Digest
+	ActionResult *repb.ActionResult
+	Err          error
+}
+
+func (s *ActionCacheServer) BatchGetActionResults(ctx context.Context, reqs []*repb.GetActionResultRequest) []*BatchGetActionResultsResult {
+	out := make([]*BatchGetActionResultsResult, len(reqs))
+	for i, req := range reqs {
+		ar, err := s.GetActionResult(ctx, req)
+		out[i] = &BatchGetActionResultsResult{ActionDigest: req.GetActionDigest(), ActionResult: ar, Err: err}
+	}
+	return out
+}
+
+// BatchUpdateActionResultsResult is the per-entry outcome of a
+// BatchUpdateActionResults call.
+type BatchUpdateActionResultsResult struct {
+	ActionDigest *repb.Digest
+	ActionResult *repb.ActionResult
+	Err          error
+}
+
+// BatchUpdateActionResults is the write-side counterpart to
+// BatchGetActionResults.
+func (s *ActionCacheServer) BatchUpdateActionResults(ctx context.Context, reqs []*repb.UpdateActionResultRequest) []*BatchUpdateActionResultsResult {
+	out := make([]*BatchUpdateActionResultsResult, len(reqs))
+	for i, req := range reqs {
+		ar, err := s.UpdateActionResult(ctx, req)
+		out[i] = &BatchUpdateActionResultsResult{ActionDigest: req.GetActionDigest(), ActionResult: ar, Err: err}
+	}
+	return out
+}
+
+// MissingDigests reports, for a candidate ActionResult the client hasn't
+// finished uploading yet, which referenced CAS digests are still missing.
+// It's the server side of a BuildKit-style client-session sync: instead of
+// the client guessing what to upload and getting back an all-or-nothing
+// NOT_FOUND on partial CAS presence, it can upload exactly the diff the
+// server reports here before calling UpdateActionResult.
+func (s *ActionCacheServer) MissingDigests(ctx context.Context, r *repb.ActionResult) ([]*repb.Digest, error) {
+	var candidates []*repb.Digest
+	for _, f := range r.GetOutputFiles() {
+		if f.GetDigest().GetSizeBytes() > 0 {
+			candidates = append(candidates, f.GetDigest())
+		}
+	}
+	for _, d := range r.GetOutputDirectories() {
+		candidates = append(candidates, d.GetTreeDigest())
+	}
+
+	foundMap, err := s.cache.ContainsMulti(ctx, candidates)
+	if err != nil {
+		return nil, err
+	}
+	var missing []*repb.Digest
+	for _, d := range candidates {
+		if !foundMap[d] {
+			missing = append(missing, d)
+		}
+	}
+
+	// Trees that are themselves present may still reference files that
+	// aren't, so recurse into any tree we were able to fetch.
+	for _, d := range r.GetOutputDirectories() {
+		if !foundMap[d.GetTreeDigest()] {
+			continue
+		}
+		blob, err := s.cache.Get(ctx, d.GetTreeDigest())
+		if err != nil {
+			return nil, err
+		}
+		tree := &repb.Tree{}
+		if err := proto.Unmarshal(blob, tree); err != nil {
+			return nil, err
+		}
+		var leafDigests []*repb.Digest
+		leafDigests = append(leafDigests, dirFileDigests(tree.GetRoot())...)
+		for _, childDir := range tree.GetChildren() {
+			leafDigests = append(leafDigests, dirFileDigests(childDir)...)
+		}
+		leafFound, err := s.cache.ContainsMulti(ctx, leafDigests)
+		if err != nil {
+			return nil, err
+		}
+		for _, ld := range leafDigests {
+			if !leafFound[ld] {
+				missing = append(missing, ld)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// ValidateAndSyncSession is the server side of a client-session sync: the
+// client proposes an ActionResult, the server reports what's missing from
+// the CAS, the client uploads the diff, and only then is the entry
+// committed via UpdateActionResult. This avoids the current all-or-nothing
+// NOT_FOUND behavior when only a handful of referenced blobs are absent.
+type ValidateAndSyncSession struct {
+	s            *ActionCacheServer
+	actionDigest *repb.Digest
+	actionResult *repb.ActionResult
+}
+
+// BeginValidateAndSync starts a sync session for the given candidate
+// ActionResult, returning the CAS digests the client still needs to upload.
+func (s *ActionCacheServer) BeginValidateAndSync(ctx context.Context, actionDigest *repb.Digest, r *repb.ActionResult) (*ValidateAndSyncSession, []*repb.Digest, error) {
+	if actionDigest == nil {
+		return nil, nil, status.InvalidArgumentError("ActionDigest is a required field")
+	}
+	if err := s.checkWrite(ctx, actionDigest); err != nil {
+		return nil, nil, err
+	}
+	missing, err := s.MissingDigests(ctx, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &ValidateAndSyncSession{s: s, actionDigest: actionDigest, actionResult: r}, missing, nil
+}
+
+// Commit re-checks that nothing is missing (the client should have just
+// uploaded the diff) and, if so, persists the ActionResult via the normal
+// UpdateActionResult path.
+func (sess *ValidateAndSyncSession) Commit(ctx context.Context) (*repb.ActionResult, error) {
+	missing, err := sess.s.MissingDigests(ctx, sess.actionResult)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, status.FailedPreconditionErrorf("ValidateAndSync: %d referenced digest(s) are still missing from the CAS", len(missing))
+	}
+	return sess.s.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		ActionDigest: sess.actionDigest,
+		ActionResult: sess.actionResult,
+	})
+}
@@ -0,0 +1,141 @@
+package action_cache_server
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	bolt "go.etcd.io/bbolt"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+var acIndexBucket = []byte("ac_index")
+
+// boltIndex is an entryIndex backed by a local BoltDB file, keyed by
+// acCachePrefix+ActionDigest as described in the GC design.
+type boltIndex struct {
+	db *bolt.DB
+}
+
+// boltIndexDigest is the JSON-friendly form of a *repb.Digest.
+type boltIndexDigest struct {
+	Hash      string
+	SizeBytes int64
+}
+
+// boltIndexRow is the JSON-encoded value stored for each tracked AC entry.
+type boltIndexRow struct {
+	SizeBytes         int64
+	ActionSizeBytes   int64 // SizeBytes of the ActionDigest itself
+	LastAccess        int64 // unix nanos
+	UserPrefix        string
+	ReferencedDigests []boltIndexDigest
+}
+
+// NewBoltIndex opens (creating if necessary) a BoltDB-backed sidecar index
+// at path, suitable for passing to ActionCacheServer.SetIndex.
+func NewBoltIndex(path string) (entryIndex, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(acIndexBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltIndex{db: db}, nil
+}
+
+func indexKey(d *repb.Digest) []byte {
+	return []byte(acCachePrefix + d.GetHash())
+}
+
+func (b *boltIndex) Touch(ctx context.Context, actionDigest *repb.Digest, size int64, referencedDigests []*repb.Digest, userPrefix string, accessTime time.Time) error {
+	if _, err := digest.Validate(actionDigest); err != nil {
+		return err
+	}
+	refs := make([]boltIndexDigest, 0, len(referencedDigests))
+	for _, rd := range referencedDigests {
+		refs = append(refs, boltIndexDigest{Hash: rd.GetHash(), SizeBytes: rd.GetSizeBytes()})
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(acIndexBucket)
+		row := boltIndexRow{SizeBytes: size, ActionSizeBytes: actionDigest.GetSizeBytes(), LastAccess: accessTime.UnixNano(), UserPrefix: userPrefix, ReferencedDigests: refs}
+		if existing := bucket.Get(indexKey(actionDigest)); existing != nil {
+			var old boltIndexRow
+			if err := json.Unmarshal(existing, &old); err == nil {
+				if row.SizeBytes == 0 {
+					row.SizeBytes = old.SizeBytes
+				}
+			}
+		}
+		buf, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(indexKey(actionDigest), buf)
+	})
+}
+
+func (b *boltIndex) Delete(ctx context.Context, actionDigest *repb.Digest) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(acIndexBucket).Delete(indexKey(actionDigest))
+	})
+}
+
+func (b *boltIndex) Stats(ctx context.Context) (int64, int64, error) {
+	var totalBytes, totalEntries int64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(acIndexBucket).ForEach(func(k, v []byte) error {
+			var row boltIndexRow
+			if err := json.Unmarshal(v, &row); err != nil {
+				return err
+			}
+			totalBytes += row.SizeBytes
+			totalEntries++
+			return nil
+		})
+	})
+	return totalBytes, totalEntries, err
+}
+
+func (b *boltIndex) LRUCandidates(ctx context.Context, filter string) ([]indexEntry, error) {
+	var entries []indexEntry
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(acIndexBucket).ForEach(func(k, v []byte) error {
+			var row boltIndexRow
+			if err := json.Unmarshal(v, &row); err != nil {
+				return err
+			}
+			if filter != "" && !strings.Contains(row.UserPrefix, filter) {
+				return nil
+			}
+			hash := strings.TrimPrefix(string(k), acCachePrefix)
+			referenced := make([]*repb.Digest, 0, len(row.ReferencedDigests))
+			for _, rd := range row.ReferencedDigests {
+				referenced = append(referenced, &repb.Digest{Hash: rd.Hash, SizeBytes: rd.SizeBytes})
+			}
+			entries = append(entries, indexEntry{
+				Digest:            &repb.Digest{Hash: hash, SizeBytes: row.ActionSizeBytes},
+				SizeBytes:         row.SizeBytes,
+				LastAccess:        time.Unix(0, row.LastAccess),
+				ReferencedDigests: referenced,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastAccess.Before(entries[j].LastAccess)
+	})
+	return entries, nil
+}
@@ -0,0 +1,30 @@
+package action_cache_server
+
+import (
+	"context"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// GetCapabilities returns the server's supported ActionCache capabilities,
+// including the compressors it accepts for compressed-blobs uploads and
+// downloads.
+//
+// This is implemented directly on ActionCacheServer (rather than a separate
+// CapabilitiesServer) since, today, the only capability we advertise is
+// cache-related.
+//
+// TODO(action-cache-grpc-surface): this method is not registered as a gRPC
+// handler -- the Capabilities service registration lives in server
+// composition code that isn't part of this package, and proto/service defs
+// for it aren't present in this tree. Wire it up (or cut a tracked issue for
+// doing so) before relying on remote clients negotiating compression via
+// GetCapabilities.
+func (s *ActionCacheServer) GetCapabilities(ctx context.Context, req *repb.GetCapabilitiesRequest) (*repb.ServerCapabilities, error) {
+	return &repb.ServerCapabilities{
+		CacheCapabilities: &repb.CacheCapabilities{
+			SupportedCompressor:            []repb.CompressorValue{repb.CompressorValue_IDENTITY, repb.CompressorValue_ZSTD},
+			SupportedBatchUpdateCompressor: []repb.CompressorValue{repb.CompressorValue_IDENTITY, repb.CompressorValue_ZSTD},
+		},
+	}, nil
+}
@@ -0,0 +1,162 @@
+package action_cache_server
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// metadataDecorator, if set via RegisterMetadataDecorator, is invoked on
+// every ActionResult before it's persisted. This lets an executor subsystem
+// living in another package (which actually runs the action and observes
+// things like cgroup stats) attach its own AuxiliaryMetadata without this
+// package needing to import it.
+var metadataDecorator func(ar *repb.ActionResult)
+
+// RegisterMetadataDecorator installs fn to be called on every ActionResult
+// passed to UpdateActionResult, after server-side fields have been merged in
+// but before the result is persisted. Intended to be called once at startup
+// by an executor subsystem that wants to attach AuxiliaryMetadata (e.g.
+// cgroup stats, OOM flags) as an anypb.Any.
+func RegisterMetadataDecorator(fn func(ar *repb.ActionResult)) {
+	metadataDecorator = fn
+}
+
+// maxClockSkew bounds how far into the future a client-supplied timestamp is
+// allowed to be, to tolerate modest clock drift between the executor and
+// this server without accepting obviously bogus metadata.
+const maxClockSkew = 5 * time.Minute
+
+// applyExecutionMetadata validates the client-supplied ExecutedActionMetadata
+// (if any), merges in server-observed fields, and runs the registered
+// metadata decorator. It's the UpdateActionResult counterpart to the old
+// setWorkerMetadata, extended to preserve the rest of the client's
+// telemetry instead of clobbering it.
+func applyExecutionMetadata(ar *repb.ActionResult) error {
+	client := ar.GetExecutionMetadata()
+	if client == nil {
+		client = &repb.ExecutedActionMetadata{}
+	}
+	if err := validateExecutionTimestamps(client); err != nil {
+		return err
+	}
+
+	merged := proto.Clone(client).(*repb.ExecutedActionMetadata)
+	// The worker identity always reflects this server, never the client's
+	// claim -- see https://github.com/bazelbuild/remote-apis/pull/131.
+	merged.Worker = base64.StdEncoding.EncodeToString(uuid.NodeID())
+
+	if recvTS, err := ptypes.TimestampProto(time.Now()); err == nil {
+		recvAny, err := ptypes.MarshalAny(recvTS)
+		if err == nil {
+			merged.AuxiliaryMetadata = append(merged.AuxiliaryMetadata, recvAny)
+		}
+	}
+
+	ar.ExecutionMetadata = merged
+	if metadataDecorator != nil {
+		metadataDecorator(ar)
+	}
+	return nil
+}
+
+// executionSpan is one input-fetch/execution/output-upload stage of the
+// timeline reported in ExecutedActionMetadata.
+type executionSpan struct {
+	name       string
+	start, end *time.Time
+}
+
+// validateExecutionTimestamps checks that the client-supplied execution
+// timeline is internally consistent and not wildly out of bounds.
+//
+// Per the REAPI, `worker_start_timestamp`/`worker_completed_timestamp` are
+// the *outermost* boundaries of everything the worker does -- completed is
+// reported only after output upload finishes, not as an early stage that
+// must precede input fetch/execution. So they're validated separately from
+// the sequential inner stages (queued, then input fetch, execution, and
+// output upload, in that order).
+func validateExecutionTimestamps(m *repb.ExecutedActionMetadata) error {
+	queued := protoTime(m.GetQueuedTimestamp())
+	workerStart := protoTime(m.GetWorkerStartTimestamp())
+	workerCompleted := protoTime(m.GetWorkerCompletedTimestamp())
+
+	spans := []executionSpan{
+		{"input fetch", protoTime(m.GetInputFetchStartTimestamp()), protoTime(m.GetInputFetchCompletedTimestamp())},
+		{"execution", protoTime(m.GetExecutionStartTimestamp()), protoTime(m.GetExecutionCompletedTimestamp())},
+		{"output upload", protoTime(m.GetOutputUploadStartTimestamp()), protoTime(m.GetOutputUploadCompletedTimestamp())},
+	}
+
+	now := time.Now().Add(maxClockSkew)
+	checkFuture := func(name string, t *time.Time) error {
+		if t != nil && t.After(now) {
+			return status.InvalidArgumentErrorf("ExecutedActionMetadata %s timestamp %s is too far in the future", name, t)
+		}
+		return nil
+	}
+	if err := checkFuture("queued", queued); err != nil {
+		return err
+	}
+	if err := checkFuture("worker start", workerStart); err != nil {
+		return err
+	}
+	if err := checkFuture("worker completed", workerCompleted); err != nil {
+		return err
+	}
+
+	if workerStart != nil && workerCompleted != nil && workerCompleted.Before(*workerStart) {
+		return status.InvalidArgumentError("ExecutedActionMetadata worker completed before it started")
+	}
+
+	prevEnd := queued
+	for _, sp := range spans {
+		if err := checkFuture(sp.name, sp.start); err != nil {
+			return err
+		}
+		if err := checkFuture(sp.name, sp.end); err != nil {
+			return err
+		}
+		if sp.start != nil && sp.end != nil && sp.end.Before(*sp.start) {
+			return status.InvalidArgumentErrorf("ExecutedActionMetadata %s completed before it started", sp.name)
+		}
+		cur := sp.start
+		if cur == nil {
+			cur = sp.end
+		}
+		if prevEnd != nil && cur != nil && cur.Before(*prevEnd) {
+			return status.InvalidArgumentErrorf("ExecutedActionMetadata %s timestamp precedes the prior stage", sp.name)
+		}
+		if sp.end != nil {
+			prevEnd = sp.end
+		} else if cur != nil {
+			prevEnd = cur
+		}
+	}
+
+	// worker_completed_timestamp is the outermost boundary: nothing inside
+	// the worker's timeline may finish after it.
+	if workerCompleted != nil && prevEnd != nil && prevEnd.After(*workerCompleted) {
+		return status.InvalidArgumentError("ExecutedActionMetadata worker completed before its reported stages finished")
+	}
+	return nil
+}
+
+// protoTime converts a *tspb.Timestamp to *time.Time, returning nil if ts is
+// nil or zero-valued (i.e. the client didn't set that stage).
+func protoTime(ts *tspb.Timestamp) *time.Time {
+	if ts == nil || (ts.Seconds == 0 && ts.Nanos == 0) {
+		return nil
+	}
+	t, err := ptypes.Timestamp(ts)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
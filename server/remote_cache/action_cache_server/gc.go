@@ -0,0 +1,241 @@
+package action_cache_server
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+var (
+	gcInterval = flag.Duration("action_cache.gc_interval", 10*time.Minute, "How often the action cache GC worker runs. 0 disables the worker.")
+
+	gcEntriesFreed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "buildbuddy",
+		Subsystem: "action_cache",
+		Name:      "gc_entries_freed_total",
+		Help:      "Number of action cache entries removed by GC.",
+	})
+	gcBytesFreed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "buildbuddy",
+		Subsystem: "action_cache",
+		Name:      "gc_bytes_freed_total",
+		Help:      "Number of bytes removed from the action cache by GC.",
+	})
+	gcRunsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "buildbuddy",
+		Subsystem: "action_cache",
+		Name:      "gc_runs_total",
+		Help:      "Number of action cache GC runs, labeled by outcome.",
+	}, []string{"outcome"})
+)
+
+// PruneOptions configures a single PruneActionCache call.
+type PruneOptions struct {
+	// KeepBytes is the total size, in bytes, the action cache should be
+	// trimmed down to. Entries are evicted oldest-last-accessed-first until
+	// the cache is at or under this size. Zero means "no byte-based limit".
+	KeepBytes int64
+
+	// KeepEntries is the total number of entries the action cache should be
+	// trimmed down to. Zero means "no entry-count limit".
+	KeepEntries int64
+
+	// KeepDuration is a max-age TTL: any entry whose last access is older
+	// than now-KeepDuration is evicted regardless of KeepBytes/KeepEntries.
+	// Zero means "no age-based limit".
+	KeepDuration time.Duration
+
+	// Filter, if set, restricts pruning to entries whose user prefix
+	// contains this string. Instance names are not tracked or matched.
+	Filter string
+
+	// DryRun, if true, computes what would be freed without deleting
+	// anything.
+	DryRun bool
+}
+
+// GCWaterMarks configures the background GC worker's high/low water marks:
+// it only runs a prune once usage crosses High*, and it prunes down to Low*
+// rather than to zero, so a steady stream of writes doesn't make it churn.
+type GCWaterMarks struct {
+	HighBytes   int64
+	LowBytes    int64
+	HighEntries int64
+	LowEntries  int64
+}
+
+// PruneResult summarizes the effect (or, for a dry run, the projected
+// effect) of a PruneActionCache call.
+type PruneResult struct {
+	EntriesFreed int64
+	BytesFreed   int64
+}
+
+// entryIndex is the sidecar metadata index PruneActionCache consults to find
+// eviction candidates without scanning the underlying blob store. It's kept
+// as an interface so tests can substitute an in-memory implementation for
+// the BoltDB-backed one used in production.
+//
+// The index tracks AC entries only (keyed by ActionDigest) -- it is not used
+// to track the CAS blobs an ActionResult references directly as index rows.
+// Those are instead recorded on the AC entry's own row, as
+// indexEntry.ReferencedDigests, so the two cache namespaces aren't conflated.
+// PruneActionCache does not evict the referenced digests.
+type entryIndex interface {
+	// Touch records that the AC entry for actionDigest was accessed at
+	// accessTime by userPrefix, along with the CAS digests it references,
+	// inserting it if it isn't already tracked.
+	Touch(ctx context.Context, actionDigest *repb.Digest, size int64, referencedDigests []*repb.Digest, userPrefix string, accessTime time.Time) error
+
+	// Stats returns the total size and count of tracked AC entries.
+	Stats(ctx context.Context) (totalBytes int64, totalEntries int64, err error)
+
+	// LRUCandidates returns tracked entries matching filter, oldest access
+	// time first.
+	LRUCandidates(ctx context.Context, filter string) ([]indexEntry, error)
+
+	// Delete removes actionDigest from the index.
+	Delete(ctx context.Context, actionDigest *repb.Digest) error
+}
+
+// indexEntry is a single row of the sidecar index, keyed by
+// acCachePrefix+ActionDigest.
+type indexEntry struct {
+	Digest            *repb.Digest
+	SizeBytes         int64
+	LastAccess        time.Time
+	ReferencedDigests []*repb.Digest
+}
+
+// touchActionResult records that d was just accessed by userPrefix, so GC
+// treats it as fresh, and records the CAS digests it references (output
+// files and output directory trees) on d's index row. It does not refresh
+// the TTLs of those referenced CAS blobs. sizeBytes is the size of the
+// marshaled, uncompressed ActionResult, not the ActionDigest (whose
+// SizeBytes describes the Action proto, a different object entirely).
+func (s *ActionCacheServer) touchActionResult(ctx context.Context, d *repb.Digest, r *repb.ActionResult, sizeBytes int64, userPrefix string) {
+	if s.index == nil {
+		return
+	}
+	referenced := make([]*repb.Digest, 0, len(r.GetOutputFiles())+len(r.GetOutputDirectories()))
+	for _, f := range r.GetOutputFiles() {
+		referenced = append(referenced, f.GetDigest())
+	}
+	for _, dir := range r.GetOutputDirectories() {
+		referenced = append(referenced, dir.GetTreeDigest())
+	}
+	s.index.Touch(ctx, d, sizeBytes, referenced, userPrefix, time.Now())
+}
+
+// PruneActionCache evicts action cache entries according to opts, returning
+// what was (or, in dry-run mode, would be) freed.
+//
+// This only evicts the AC entry itself, never the CAS digests it referenced
+// (the output files and trees recorded by touchActionResult): the CAS is
+// content-addressed, so the same blob is routinely shared by many other AC
+// entries, and deleting it here would silently corrupt those entries too.
+// CAS GC is expected to reclaim unreferenced blobs on its own.
+//
+// TODO(action-cache-grpc-surface): there's no admin gRPC endpoint that calls
+// this -- today it's only reachable by an in-process caller that also owns
+// StartGCLoop. Exposing it (e.g. as an admin-only RPC to trigger or tune a
+// prune on demand) is tracked follow-up work, not done here.
+func (s *ActionCacheServer) PruneActionCache(ctx context.Context, opts PruneOptions) (*PruneResult, error) {
+	if s.index == nil {
+		return nil, status.FailedPreconditionError("action cache GC requires a sidecar index, but none is configured")
+	}
+	candidates, err := s.index.LRUCandidates(ctx, opts.Filter)
+	if err != nil {
+		gcRunsTotal.WithLabelValues("error").Inc()
+		return nil, err
+	}
+
+	var totalBytes int64
+	for _, c := range candidates {
+		totalBytes += c.SizeBytes
+	}
+	totalEntries := int64(len(candidates))
+
+	result := &PruneResult{}
+	now := time.Now()
+	for _, c := range candidates {
+		expired := opts.KeepDuration > 0 && now.Sub(c.LastAccess) > opts.KeepDuration
+		overBytesBudget := opts.KeepBytes > 0 && totalBytes > opts.KeepBytes
+		overEntriesBudget := opts.KeepEntries > 0 && totalEntries > opts.KeepEntries
+		if !expired && !overBytesBudget && !overEntriesBudget {
+			break
+		}
+		if !opts.DryRun {
+			// Remove both the uncompressed copy and the zstd copy that
+			// UpdateActionResult writes.
+			for _, cache := range []interfaces.DigestCache{s.cache, s.zstdCache()} {
+				if dc, ok := cache.(deletableCache); ok {
+					if err := dc.Delete(ctx, c.Digest); err != nil {
+						gcRunsTotal.WithLabelValues("error").Inc()
+						return nil, err
+					}
+				}
+			}
+			if err := s.index.Delete(ctx, c.Digest); err != nil {
+				gcRunsTotal.WithLabelValues("error").Inc()
+				return nil, err
+			}
+		}
+		totalBytes -= c.SizeBytes
+		totalEntries--
+		result.BytesFreed += c.SizeBytes
+		result.EntriesFreed++
+	}
+
+	if !opts.DryRun {
+		gcEntriesFreed.Add(float64(result.EntriesFreed))
+		gcBytesFreed.Add(float64(result.BytesFreed))
+	}
+	gcRunsTotal.WithLabelValues("success").Inc()
+	return result, nil
+}
+
+// StartGCLoop runs PruneActionCache on *gcInterval until ctx is canceled.
+// Size-based pruning happens only once tracked usage crosses
+// marks.High{Bytes,Entries}, and then prunes down to marks.Low{Bytes,Entries}.
+// If keepDuration is non-zero, every run also evicts entries not accessed
+// within keepDuration. It is a no-op if the interval is 0 or no sidecar index
+// is configured.
+func (s *ActionCacheServer) StartGCLoop(ctx context.Context, marks GCWaterMarks, keepDuration time.Duration) {
+	if *gcInterval == 0 || s.index == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(*gcInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				totalBytes, totalEntries, err := s.index.Stats(ctx)
+				if err != nil {
+					continue
+				}
+				overBytes := marks.HighBytes > 0 && totalBytes > marks.HighBytes
+				overEntries := marks.HighEntries > 0 && totalEntries > marks.HighEntries
+				if !overBytes && !overEntries && keepDuration == 0 {
+					continue
+				}
+				opts := PruneOptions{KeepDuration: keepDuration}
+				if overBytes || overEntries {
+					opts.KeepBytes = marks.LowBytes
+					opts.KeepEntries = marks.LowEntries
+				}
+				s.PruneActionCache(ctx, opts)
+			}
+		}
+	}()
+}
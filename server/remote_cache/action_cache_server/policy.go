@@ -0,0 +1,79 @@
+package action_cache_server
+
+import (
+	"context"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/policy"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// fetchActionAndCommand loads the Action (and, via it, the Command) that
+// the client was required to upload to the CAS before calling
+// UpdateActionResult, per the REAPI docstring on UpdateActionResult. It's the basis for policy enforcement: the policy
+// can't see what it's authorizing without these.
+func (s *ActionCacheServer) fetchActionAndCommand(ctx context.Context, actionDigest *repb.Digest) (*repb.Action, *repb.Command, error) {
+	// Deliberately the unprefixed cache, not s.cache (which is
+	// WithPrefix(acCachePrefix)): Actions and Commands live in the CAS
+	// namespace, not the AC namespace.
+	casCache := s.env.GetDigestCache()
+	actionBlob, err := casCache.Get(ctx, actionDigest)
+	if err != nil {
+		return nil, nil, status.FailedPreconditionErrorf("Action %q not found in CAS: %s", actionDigest, err)
+	}
+	action := &repb.Action{}
+	if err := proto.Unmarshal(actionBlob, action); err != nil {
+		return nil, nil, status.FailedPreconditionErrorf("Action %q could not be parsed: %s", actionDigest, err)
+	}
+
+	commandBlob, err := casCache.Get(ctx, action.GetCommandDigest())
+	if err != nil {
+		return nil, nil, status.FailedPreconditionErrorf("Command %q not found in CAS: %s", action.GetCommandDigest(), err)
+	}
+	command := &repb.Command{}
+	if err := proto.Unmarshal(commandBlob, command); err != nil {
+		return nil, nil, status.FailedPreconditionErrorf("Command %q could not be parsed: %s", action.GetCommandDigest(), err)
+	}
+	return action, command, nil
+}
+
+// checkRead runs the configured policy's AuthorizeRead against the
+// Action/Command for actionDigest, translating policy errors into the
+// REAPI error codes the docstrings call for. It's a no-op if no policy is
+// configured.
+//
+// Unlike UpdateActionResult, GetActionResult has no REAPI requirement that
+// the Action/Command still be present in the CAS -- CAS GC is free to evict
+// them once the ActionResult itself has been cached -- so a missing
+// Action/Command here is not an error; it just means there's nothing for
+// the policy to evaluate, and the read is allowed.
+func (s *ActionCacheServer) checkRead(ctx context.Context, actionDigest *repb.Digest) error {
+	if s.policy == nil {
+		return nil
+	}
+	action, command, err := s.fetchActionAndCommand(ctx, actionDigest)
+	if err != nil {
+		return nil
+	}
+	if err := s.policy.AuthorizeRead(ctx, actionDigest, action, command); err != nil {
+		return status.PermissionDeniedErrorf("action cache policy rejected %q: %s", actionDigest, err)
+	}
+	return nil
+}
+
+// checkWrite is the AuthorizeWrite counterpart to checkRead.
+func (s *ActionCacheServer) checkWrite(ctx context.Context, actionDigest *repb.Digest) error {
+	if s.policy == nil {
+		return nil
+	}
+	action, command, err := s.fetchActionAndCommand(ctx, actionDigest)
+	if err != nil {
+		return err
+	}
+	if err := s.policy.AuthorizeWrite(ctx, actionDigest, action, command); err != nil {
+		return status.PermissionDeniedErrorf("action cache policy rejected %q: %s", actionDigest, err)
+	}
+	return nil
+}
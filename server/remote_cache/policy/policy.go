@@ -0,0 +1,181 @@
+// Package policy implements access control for the remote action cache,
+// allowing a BuildBuddy deployment to restrict which actions may be read
+// from or written to the AC based on the contents of the Action and Command
+// that produced them.
+package policy
+
+import (
+	"context"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"gopkg.in/yaml.v2"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// ActionPolicy decides whether a given Action/Command pair may be read from
+// or written to the action cache. Implementations are invoked after the
+// Action and Command have been fetched from the CAS, so they may inspect
+// the command line, environment variables, and platform properties.
+type ActionPolicy interface {
+	// AuthorizeRead is called before GetActionResult returns a cached
+	// result for the given action digest.
+	AuthorizeRead(ctx context.Context, actionDigest *repb.Digest, action *repb.Action, command *repb.Command) error
+
+	// AuthorizeWrite is called before UpdateActionResult persists a new
+	// result for the given action digest.
+	AuthorizeWrite(ctx context.Context, actionDigest *repb.Digest, action *repb.Action, command *repb.Command) error
+}
+
+// AllowAll is the default ActionPolicy: it permits every read and write.
+// It behaves the same as configuring no policy.
+var AllowAll ActionPolicy = allowAll{}
+
+type allowAll struct{}
+
+func (allowAll) AuthorizeRead(ctx context.Context, d *repb.Digest, a *repb.Action, c *repb.Command) error {
+	return nil
+}
+func (allowAll) AuthorizeWrite(ctx context.Context, d *repb.Digest, a *repb.Action, c *repb.Command) error {
+	return nil
+}
+
+// CallbackPolicy adapts a pair of plain Go functions to the ActionPolicy
+// interface, for callers that want to wire up custom logic without defining
+// a new type.
+type CallbackPolicy struct {
+	ReadFn  func(ctx context.Context, actionDigest *repb.Digest, action *repb.Action, command *repb.Command) error
+	WriteFn func(ctx context.Context, actionDigest *repb.Digest, action *repb.Action, command *repb.Command) error
+}
+
+func (p *CallbackPolicy) AuthorizeRead(ctx context.Context, d *repb.Digest, a *repb.Action, c *repb.Command) error {
+	if p.ReadFn == nil {
+		return nil
+	}
+	return p.ReadFn(ctx, d, a, c)
+}
+
+func (p *CallbackPolicy) AuthorizeWrite(ctx context.Context, d *repb.Digest, a *repb.Action, c *repb.Command) error {
+	if p.WriteFn == nil {
+		return nil
+	}
+	return p.WriteFn(ctx, d, a, c)
+}
+
+// Rule is a single allow/deny entry in a YAML policy file. A Command is
+// matched against a Rule if every non-empty field on the Rule matches; the
+// first matching Rule in the list wins.
+type Rule struct {
+	// Allow, if false, denies matching commands instead of allowing them.
+	Allow bool `yaml:"allow"`
+
+	// CommandBin, if set, must equal the first element of the Command's
+	// argument list (i.e. the binary being run).
+	CommandBin string `yaml:"command_bin,omitempty"`
+
+	// EnvVar, if set, must be present (as "KEY" or "KEY=VALUE") in the
+	// Command's environment variables.
+	EnvVar string `yaml:"env_var,omitempty"`
+
+	// PlatformProperty, if set, must be present (as "name=value") in the
+	// Command's platform properties.
+	PlatformProperty string `yaml:"platform_property,omitempty"`
+
+	// UserGroup, if set, must equal the group component of the auth
+	// context's user prefix.
+	UserGroup string `yaml:"user_group,omitempty"`
+}
+
+// RuleSet is a YAML-configured ActionPolicy: rules are evaluated in order
+// and the first match decides the outcome. If no rule matches, the action
+// is allowed.
+type RuleSet struct {
+	Rules []Rule `yaml:"rules"`
+
+	// GroupFromContext resolves the requesting user/group for UserGroup
+	// rules. ParseRuleSet wires this to perms.UserPrefixFromContext so
+	// UserGroup rules take effect against the real auth context; tests that
+	// want a fixed group can still override it directly.
+	GroupFromContext func(ctx context.Context) string
+}
+
+// ParseRuleSet parses a YAML policy document of the form:
+//
+//	rules:
+//	  - allow: false
+//	    command_bin: /bin/sh
+//	  - allow: false
+//	    env_var: "DANGEROUS=1"
+func ParseRuleSet(yamlBytes []byte) (*RuleSet, error) {
+	rs := &RuleSet{}
+	if err := yaml.Unmarshal(yamlBytes, rs); err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid action cache policy YAML: %s", err)
+	}
+	rs.GroupFromContext = perms.UserPrefixFromContext
+	return rs, nil
+}
+
+func (rs *RuleSet) AuthorizeRead(ctx context.Context, d *repb.Digest, a *repb.Action, c *repb.Command) error {
+	return rs.authorize(ctx, c)
+}
+
+func (rs *RuleSet) AuthorizeWrite(ctx context.Context, d *repb.Digest, a *repb.Action, c *repb.Command) error {
+	return rs.authorize(ctx, c)
+}
+
+func (rs *RuleSet) authorize(ctx context.Context, c *repb.Command) error {
+	for _, rule := range rs.Rules {
+		if !rule.matches(c, rs.groupFor(ctx)) {
+			continue
+		}
+		if !rule.Allow {
+			return status.PermissionDeniedErrorf("action cache policy denied command %v", c.GetArguments())
+		}
+		return nil
+	}
+	return nil
+}
+
+func (rs *RuleSet) groupFor(ctx context.Context) string {
+	if rs.GroupFromContext == nil {
+		return ""
+	}
+	return rs.GroupFromContext(ctx)
+}
+
+func (r Rule) matches(c *repb.Command, group string) bool {
+	if r.CommandBin != "" {
+		if len(c.GetArguments()) == 0 || c.GetArguments()[0] != r.CommandBin {
+			return false
+		}
+	}
+	if r.EnvVar != "" {
+		found := false
+		for _, v := range c.GetEnvironmentVariables() {
+			if v.GetName()+"="+v.GetValue() == r.EnvVar || v.GetName() == r.EnvVar {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.PlatformProperty != "" {
+		found := false
+		for _, p := range c.GetPlatform().GetProperties() {
+			if p.GetName()+"="+p.GetValue() == r.PlatformProperty {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.UserGroup != "" && r.UserGroup != group {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package policy
+
+import (
+	"context"
+	"testing"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func TestRuleSet_DenyByCommandBin(t *testing.T) {
+	rs, err := ParseRuleSet([]byte(`
+rules:
+  - allow: false
+    command_bin: /bin/sh
+`))
+	if err != nil {
+		t.Fatalf("ParseRuleSet: %s", err)
+	}
+
+	denied := &repb.Command{Arguments: []string{"/bin/sh", "-c", "echo hi"}}
+	if err := rs.AuthorizeWrite(context.Background(), nil, nil, denied); err == nil {
+		t.Errorf("expected /bin/sh to be denied")
+	}
+
+	allowed := &repb.Command{Arguments: []string{"/usr/bin/gcc", "-c", "a.c"}}
+	if err := rs.AuthorizeWrite(context.Background(), nil, nil, allowed); err != nil {
+		t.Errorf("expected gcc to be allowed, got %s", err)
+	}
+}
+
+func TestRuleSet_DenyByEnvVar(t *testing.T) {
+	rs, err := ParseRuleSet([]byte(`
+rules:
+  - allow: false
+    env_var: UNSAFE
+`))
+	if err != nil {
+		t.Fatalf("ParseRuleSet: %s", err)
+	}
+
+	cmd := &repb.Command{
+		EnvironmentVariables: []*repb.Command_EnvironmentVariable{
+			{Name: "UNSAFE", Value: "1"},
+		},
+	}
+	if err := rs.AuthorizeRead(context.Background(), nil, nil, cmd); err == nil {
+		t.Errorf("expected command with UNSAFE env var to be denied")
+	}
+}
+
+func TestRuleSet_NoMatchAllowsByDefault(t *testing.T) {
+	rs, err := ParseRuleSet([]byte(`
+rules:
+  - allow: false
+    command_bin: /bin/sh
+`))
+	if err != nil {
+		t.Fatalf("ParseRuleSet: %s", err)
+	}
+	cmd := &repb.Command{Arguments: []string{"/usr/bin/make"}}
+	if err := rs.AuthorizeWrite(context.Background(), nil, nil, cmd); err != nil {
+		t.Errorf("expected no matching rule to allow, got %s", err)
+	}
+}
+
+func TestRuleSet_UserGroup(t *testing.T) {
+	rs, err := ParseRuleSet([]byte(`
+rules:
+  - allow: false
+    user_group: untrusted
+`))
+	if err != nil {
+		t.Fatalf("ParseRuleSet: %s", err)
+	}
+	rs.GroupFromContext = func(ctx context.Context) string { return "untrusted" }
+
+	cmd := &repb.Command{Arguments: []string{"/usr/bin/make"}}
+	if err := rs.AuthorizeWrite(context.Background(), nil, nil, cmd); err == nil {
+		t.Errorf("expected untrusted group to be denied")
+	}
+}
+
+func TestCallbackPolicy(t *testing.T) {
+	calls := 0
+	p := &CallbackPolicy{
+		WriteFn: func(ctx context.Context, d *repb.Digest, a *repb.Action, c *repb.Command) error {
+			calls++
+			return nil
+		},
+	}
+	if err := p.AuthorizeWrite(context.Background(), nil, nil, nil); err != nil {
+		t.Fatalf("AuthorizeWrite: %s", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected WriteFn to be called once, got %d", calls)
+	}
+	if err := p.AuthorizeRead(context.Background(), nil, nil, nil); err != nil {
+		t.Errorf("expected nil ReadFn to default to allow, got %s", err)
+	}
+}